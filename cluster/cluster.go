@@ -10,6 +10,10 @@ import (
 	"sync"
 	"time"
 
+	hraft "github.com/hashicorp/raft"
+	"github.com/werbenhu/amqtt/cluster/discovery"
+	"github.com/werbenhu/amqtt/cluster/raft"
+	"github.com/werbenhu/amqtt/cluster/session"
 	"github.com/werbenhu/amqtt/config"
 	"github.com/werbenhu/amqtt/ifs"
 	"github.com/werbenhu/amqtt/logger"
@@ -21,26 +25,100 @@ type Cluster struct {
 	cancel    context.CancelFunc
 	s         ifs.Server
 	processor ifs.Processor
+	raft      *raft.Store
+	discovery *discovery.Discovery
+	listener  net.Listener
+	conns     sync.Map // net.Conn -> struct{}, accepted connections still being handled
+	stop      chan struct{}
+	wg        sync.WaitGroup
 }
 
 func NewCluster(server ifs.Server) *Cluster {
 	c := new(Cluster)
 	c.s = server
+	c.stop = make(chan struct{})
 	c.ctx, c.cancel = context.WithCancel(server.Context())
-	c.processor = NewProcessor(server)
+
+	peers := make([]hraft.Server, 0, len(config.Clusters())+1)
+	peers = append(peers, hraft.Server{ID: hraft.ServerID(config.ClusterName()), Address: hraft.ServerAddress(config.RaftBind())})
+	for _, cluster := range config.Clusters() {
+		peers = append(peers, hraft.Server{ID: hraft.ServerID(cluster.Name), Address: hraft.ServerAddress(cluster.RaftBind)})
+	}
+
+	raftStore, err := raft.NewStore(server, config.ClusterName(), config.RaftBind(), config.RaftDir(), peers, c.onSessionTakeover)
+	if err != nil {
+		logger.Fatalf("cluster start raft store error:%s", err)
+	}
+	c.raft = raftStore
+
+	c.processor = NewProcessor(server, raftStore)
+
+	meta := discovery.Meta{Name: config.ClusterName(), Host: config.ClusterHost(), Tls: config.ClusterTls()}
+	seeds := make([]string, 0, len(config.Clusters()))
+	for _, cluster := range config.Clusters() {
+		seeds = append(seeds, cluster.GossipHost)
+	}
+	disc, err := discovery.NewDiscovery(meta, config.GossipPort(), seeds, c.onMemberJoin, c.onMemberLeave)
+	if err != nil {
+		logger.Fatalf("cluster start discovery error:%s", err)
+	}
+	c.discovery = disc
 	return c
 }
 
+// onMemberJoin is invoked by memberlist when a node joins the mesh; it
+// dials the node the same way a config.Clusters() entry used to.
+func (c *Cluster) onMemberJoin(m discovery.Meta) {
+	if _, ok := c.s.Clusters().Load(m.Name); ok {
+		return
+	}
+	go c.StartClient(config.ClusterNode{Name: m.Name, Host: m.Host})
+}
+
+// onMemberLeave is invoked by memberlist's failure detector when a node is
+// declared dead, replacing the old 20s ping ticker as the liveness signal.
+func (c *Cluster) onMemberLeave(m discovery.Meta) {
+	if exist, ok := c.s.Clusters().Load(m.Name); ok {
+		logger.Infof("cluster onMemberLeave closing clientId:%s", m.Name)
+		exist.(ifs.Client).Close()
+	}
+}
+
+// Raft exposes the retained-message raft group's leader/follower state.
+func (c *Cluster) Raft() *raft.Store {
+	return c.raft
+}
+
+// onSessionTakeover runs on every node once a session claim commits; only
+// the node that used to own the session acts, disconnecting its now-stale
+// local client so the new owner becomes the session's sole live connection.
+func (c *Cluster) onSessionTakeover(previous *session.Record, next *session.Record) {
+	if previous == nil || previous.OwnerNode != config.ClusterName() {
+		return
+	}
+	local, ok := c.s.LocalClients().Load(previous.ClientId)
+	if !ok {
+		return
+	}
+	logger.Infof("session takeover: clientId:%s moved from %s to %s", previous.ClientId, previous.OwnerNode, next.OwnerNode)
+	localClient := local.(ifs.Client)
+	disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	localClient.WritePacket(disconnect)
+	localClient.Close()
+}
+
 func (c *Cluster) HandlerServer(conn net.Conn) {
 	client := NewClient(conn, config.TypServer)
 	packet, err := client.ReadPacket()
 	if err != nil {
 		logger.Error("read connect packet error: ", err)
+		client.Close()
 		return
 	}
 	cp, ok := packet.(*packets.ConnectPacket)
 	if !ok {
 		logger.Error("received msg that was not connect")
+		client.Close()
 		return
 	}
 
@@ -60,7 +138,11 @@ func (c *Cluster) HandlerServer(conn net.Conn) {
 	client.ReadLoop(c.processor)
 }
 
-func (c *Cluster) StartServer() {
+// StartServer brings up the cluster TCP listener and accepts connections
+// until Close stops it. It returns a non-nil error only when the listener
+// fails in a way a backoff can't recover from; transient accept errors are
+// retried rather than taking the whole broker process down with them.
+func (c *Cluster) StartServer() error {
 	tcpHost := config.ClusterHost()
 	var tcpListener net.Listener
 	var err error
@@ -100,15 +182,41 @@ func (c *Cluster) StartServer() {
 		}
 		logger.Infof("start cluster tcp listen to %s ...", tcpHost)
 	}
+	c.listener = tcpListener
+
+	//exponential backoff on temporary accept errors (e.g. EMFILE), matching
+	//the pattern used by net/http's Server.Serve
+	backoff := 5 * time.Millisecond
+	const maxBackoff = time.Second
 
 	for {
 		conn, err := tcpListener.Accept()
 		if err != nil {
-			logger.Fatalf("cluster server tcp Accept to %s Err:%s", tcpHost, err.Error())
-			continue
-		} else {
-			go c.HandlerServer(conn)
+			select {
+			case <-c.stop:
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logger.Errorf("cluster server tcp Accept temporary error:%s, retrying in %s", err, backoff)
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+			logger.Errorf("cluster server tcp Accept to %s Err:%s", tcpHost, err.Error())
+			return err
 		}
+
+		backoff = 5 * time.Millisecond
+		c.conns.Store(conn, struct{}{})
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer c.conns.Delete(conn)
+			c.HandlerServer(conn)
+		}()
 	}
 }
 
@@ -214,36 +322,43 @@ func (c *Cluster) SyncTopics(clientId string) {
 	wg.Wait()
 }
 
+// CheckHealthy reconciles the mesh from memberlist.Members() rather than
+// config.Clusters(); onMemberJoin/onMemberLeave handle the common case as
+// events arrive, this is a periodic safety net for anything missed.
 func (c *Cluster) CheckHealthy() {
-	for _, cluster := range config.Clusters() {
-		clientId := strings.TrimSpace(cluster.Name)
-		exist, ok := c.s.Clusters().Load(clientId)
-		if !ok {
-			logger.Infof("CheckHealthy fail, connect to cluster:%+v", cluster)
-			func(cluster config.ClusterNode) {
-				go c.StartClient(cluster)
-			}(cluster)
-		} else if exist.(*Client).GetTyp() == config.TypClient {
-			ping := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
-			exist.(*Client).WritePacket(ping)
+	for _, m := range c.discovery.Members() {
+		clientId := strings.TrimSpace(m.Name)
+		if _, ok := c.s.Clusters().Load(clientId); !ok {
+			logger.Infof("CheckHealthy fail, connect to cluster node:%+v", m)
+			go c.StartClient(config.ClusterNode{Name: m.Name, Host: m.Host})
 		}
 	}
 }
 
+// HeartBeat periodically reconciles the mesh; actual liveness is now driven
+// by memberlist's own SWIM failure detector via onMemberLeave instead of
+// this ticker pinging every node every 20s.
 func (c *Cluster) HeartBeat() {
-	tick := time.NewTicker(20 * time.Second)
+	tick := time.NewTicker(30 * time.Second)
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
 		case <-tick.C:
+			if !c.discovery.Healthy() {
+				logger.Error("cluster discovery mesh lost all members")
+			}
 			c.CheckHealthy()
 		}
 	}
 }
 
 func (c *Cluster) Start() {
-	go c.StartServer()
+	go func() {
+		if err := c.StartServer(); err != nil {
+			logger.Errorf("cluster server stopped: %s", err)
+		}
+	}()
 	go c.CheckHealthy()
 	go c.HeartBeat()
 
@@ -251,6 +366,27 @@ func (c *Cluster) Start() {
 	logger.Debug("cluster done")
 }
 
+// Close stops accepting new connections, waits for in-flight handlers to
+// finish, then tears down the raft group and the discovery mesh. Accepted
+// conns are closed explicitly, not just the listener: an idle peer with no
+// pending read would otherwise leave its HandlerServer goroutine blocked in
+// ReadLoop forever, and c.wg.Wait below would never return.
 func (c *Cluster) Close() {
 	c.cancel()
+	close(c.stop)
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	c.conns.Range(func(key, _ interface{}) bool {
+		key.(net.Conn).Close()
+		return true
+	})
+	c.wg.Wait()
+
+	if err := c.discovery.Leave(); err != nil {
+		logger.Errorf("cluster close discovery leave error:%s", err)
+	}
+	if err := c.raft.Shutdown(); err != nil {
+		logger.Errorf("cluster close raft store error:%s", err)
+	}
 }
@@ -0,0 +1,141 @@
+package discovery
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/werbenhu/amqtt/config"
+	"github.com/werbenhu/amqtt/logger"
+)
+
+// Meta is advertised in every memberlist member's NodeMeta so peers know
+// which address to dial and whether TLS is required, instead of reading
+// that out of a hand-maintained config.ClusterNode list.
+type Meta struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Tls  bool   `json:"tls"`
+}
+
+// Discovery runs a SWIM gossip member list so nodes only need a couple of
+// seed addresses in config.Clusters() and learn the rest of the mesh from
+// memberlist itself. config.Clusters() is kept only as the seed source.
+type Discovery struct {
+	mu       sync.RWMutex
+	ml       *memberlist.Memberlist
+	meta     Meta
+	onJoin   func(Meta)
+	onLeave  func(Meta)
+	metaByID map[string]Meta
+}
+
+// NewDiscovery brings up a memberlist instance bound to bindPort, advertising
+// meta, and joins using seeds (config.Clusters() host:gossipPort entries) as
+// the initial contact points.
+func NewDiscovery(meta Meta, bindPort int, seeds []string, onJoin func(Meta), onLeave func(Meta)) (*Discovery, error) {
+	d := &Discovery{
+		meta:     meta,
+		onJoin:   onJoin,
+		onLeave:  onLeave,
+		metaByID: make(map[string]Meta),
+	}
+
+	mlConfig := memberlist.DefaultLANConfig()
+	mlConfig.Name = meta.Name
+	mlConfig.BindPort = bindPort
+	mlConfig.AdvertisePort = bindPort
+	mlConfig.Delegate = d
+	mlConfig.Events = d
+
+	ml, err := memberlist.Create(mlConfig)
+	if err != nil {
+		return nil, err
+	}
+	d.ml = ml
+
+	if len(seeds) > 0 {
+		if _, err := ml.Join(seeds); err != nil {
+			logger.Errorf("discovery join seeds:%+v error:%s", seeds, err)
+		}
+	}
+	return d, nil
+}
+
+// Members returns the current mesh other than this node, decoded from every
+// node's NodeMeta.
+func (d *Discovery) Members() []Meta {
+	nodes := d.ml.Members()
+	members := make([]Meta, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Name == d.meta.Name {
+			continue
+		}
+		var m Meta
+		if err := json.Unmarshal(node.Meta, &m); err != nil {
+			logger.Errorf("discovery decode node meta for %s error:%s", node.Name, err)
+			continue
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
+// Healthy reports whether memberlist still considers the mesh alive; the
+// HeartBeat ticker calls this instead of dialing every config.ClusterNode.
+// memberlist always counts the local node, so at least one other member
+// must be alive.
+func (d *Discovery) Healthy() bool {
+	return d.ml.NumMembers() > 1
+}
+
+func (d *Discovery) Leave() error {
+	return d.ml.Leave(config.ClusterLeaveTimeout())
+}
+
+// NodeMeta implements memberlist.Delegate.
+func (d *Discovery) NodeMeta(limit int) []byte {
+	data, err := json.Marshal(d.meta)
+	if err != nil {
+		logger.Errorf("discovery marshal node meta error:%s", err)
+		return nil
+	}
+	return data
+}
+
+func (d *Discovery) NotifyMsg([]byte)                           {}
+func (d *Discovery) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d *Discovery) LocalState(join bool) []byte                { return nil }
+func (d *Discovery) MergeRemoteState(buf []byte, join bool)     {}
+
+// NotifyJoin implements memberlist.EventDelegate; it decodes the node's
+// meta and hands it to the cluster mesh reconciler so it can StartClient.
+func (d *Discovery) NotifyJoin(node *memberlist.Node) {
+	var m Meta
+	if err := json.Unmarshal(node.Meta, &m); err != nil {
+		logger.Errorf("discovery NotifyJoin decode meta for %s error:%s", node.Name, err)
+		return
+	}
+	if m.Name == d.meta.Name {
+		return
+	}
+	d.mu.Lock()
+	d.metaByID[m.Name] = m
+	d.mu.Unlock()
+	if d.onJoin != nil {
+		d.onJoin(m)
+	}
+}
+
+func (d *Discovery) NotifyLeave(node *memberlist.Node) {
+	d.mu.Lock()
+	m, ok := d.metaByID[node.Name]
+	delete(d.metaByID, node.Name)
+	d.mu.Unlock()
+	if !ok || d.onLeave == nil {
+		return
+	}
+	d.onLeave(m)
+}
+
+func (d *Discovery) NotifyUpdate(node *memberlist.Node) {}
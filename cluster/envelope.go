@@ -0,0 +1,40 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// envelopeMagic marks a PUBLISH payload as carrying an origin envelope, so a
+// relay can tell a freshly-wrapped message apart from one with no envelope
+// at all (the very first hop, or anything predating this wire format).
+var envelopeMagic = [2]byte{0xA5, 0x17}
+
+// wrapOrigin prefixes raw with the node id that first introduced this
+// message to the cluster. Every relay forwards the same wrapped payload on,
+// which is what lets messageHash stay stable across a multi-hop path
+// instead of changing at every node that re-stamps it with its own id.
+func wrapOrigin(origin string, raw []byte) []byte {
+	buf := make([]byte, 0, 4+len(origin)+len(raw))
+	buf = append(buf, envelopeMagic[:]...)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(origin)))
+	buf = append(buf, length...)
+	buf = append(buf, origin...)
+	buf = append(buf, raw...)
+	return buf
+}
+
+// unwrapOrigin extracts the origin node id and raw payload from a PUBLISH
+// payload previously wrapped with wrapOrigin. ok is false if payload carries
+// no envelope, in which case payload is returned unchanged as raw.
+func unwrapOrigin(payload []byte) (origin string, raw []byte, ok bool) {
+	if len(payload) < 4 || !bytes.Equal(payload[:2], envelopeMagic[:]) {
+		return "", payload, false
+	}
+	originLen := int(binary.BigEndian.Uint16(payload[2:4]))
+	if len(payload) < 4+originLen {
+		return "", payload, false
+	}
+	return string(payload[4 : 4+originLen]), payload[4+originLen:], true
+}
@@ -0,0 +1,55 @@
+package cluster
+
+import "testing"
+
+func TestWrapUnwrapOrigin(t *testing.T) {
+	raw := []byte("hello world")
+	wrapped := wrapOrigin("node-a", raw)
+
+	origin, payload, ok := unwrapOrigin(wrapped)
+	if !ok {
+		t.Fatalf("unwrapOrigin: expected ok, got false")
+	}
+	if origin != "node-a" {
+		t.Errorf("origin = %q, want %q", origin, "node-a")
+	}
+	if string(payload) != string(raw) {
+		t.Errorf("payload = %q, want %q", payload, raw)
+	}
+}
+
+func TestUnwrapOriginNoEnvelope(t *testing.T) {
+	raw := []byte("plain payload, never wrapped")
+
+	origin, payload, ok := unwrapOrigin(raw)
+	if ok {
+		t.Fatalf("unwrapOrigin: expected ok=false for unwrapped payload")
+	}
+	if origin != "" {
+		t.Errorf("origin = %q, want empty", origin)
+	}
+	if string(payload) != string(raw) {
+		t.Errorf("payload = %q, want unchanged %q", payload, raw)
+	}
+}
+
+func TestWrapOriginSurvivesMultipleHops(t *testing.T) {
+	raw := []byte("sensor reading")
+	hop1 := wrapOrigin("node-a", raw)
+
+	origin, unwrapped, ok := unwrapOrigin(hop1)
+	if !ok || origin != "node-a" {
+		t.Fatalf("hop1: origin = %q, ok = %v, want %q, true", origin, ok, "node-a")
+	}
+
+	//a relay re-wraps with the origin it decoded, not its own id, so the
+	//hash a third hop computes is identical to the hash the first hop saw
+	hop2 := wrapOrigin(origin, unwrapped)
+	origin2, unwrapped2, ok2 := unwrapOrigin(hop2)
+	if !ok2 || origin2 != "node-a" {
+		t.Fatalf("hop2: origin = %q, ok = %v, want %q, true", origin2, ok2, "node-a")
+	}
+	if messageHash(origin, "t", unwrapped) != messageHash(origin2, "t", unwrapped2) {
+		t.Errorf("messageHash changed across a hop that preserved origin")
+	}
+}
@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// freshWindow is how long a message hash stays "fresh"; ProcessPublish
+// skips re-forwarding a fresh message to cluster peers, which is what lets
+// amqtt run over a non-full-mesh topology without messages circulating
+// forever between A->B->C->A.
+const freshWindow = 30 * time.Second
+
+// janitorInterval and entryTTL bound how long stale hashes are kept around.
+const janitorInterval = time.Minute
+const entryTTL = 5 * time.Minute
+
+// messageCache dedups cluster-forwarded PUBLISH packets by a stable hash of
+// origin+topic+payload, keyed with the time each hash was last seen.
+type messageCache struct {
+	entries sync.Map // hash string -> time.Time
+	once    sync.Once
+}
+
+// messageHash identifies a PUBLISH by origin+topic+payload, not just
+// topic+payload: two different origins publishing the same payload to the
+// same topic within freshWindow (a repeated sensor reading, a heartbeat)
+// must not collide and look like the same message looping the mesh.
+func messageHash(origin string, topic string, payload []byte) string {
+	h := sha1.New()
+	h.Write([]byte(origin))
+	h.Write([]byte(topic))
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// seenRecently reports whether hash was already seen within freshWindow,
+// and records the current sighting either way.
+func (c *messageCache) seenRecently(hash string) bool {
+	now := time.Now()
+	if last, ok := c.entries.Load(hash); ok {
+		if now.Sub(last.(time.Time)) < freshWindow {
+			c.entries.Store(hash, now)
+			return true
+		}
+	}
+	c.entries.Store(hash, now)
+	return false
+}
+
+// startJanitor sweeps entries older than entryTTL until stop is closed. It
+// is safe to call repeatedly; only the first call starts the goroutine.
+func (c *messageCache) startJanitor(stop <-chan struct{}) {
+	c.once.Do(func() {
+		go func() {
+			tick := time.NewTicker(janitorInterval)
+			defer tick.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-tick.C:
+					now := time.Now()
+					c.entries.Range(func(key, value interface{}) bool {
+						if now.Sub(value.(time.Time)) > entryTTL {
+							c.entries.Delete(key)
+						}
+						return true
+					})
+				}
+			}
+		}()
+	})
+}
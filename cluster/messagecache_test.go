@@ -0,0 +1,41 @@
+package cluster
+
+import "testing"
+
+func TestMessageHashDiffersByOrigin(t *testing.T) {
+	topic := "sensors/temp"
+	payload := []byte("21.5")
+
+	a := messageHash("node-a", topic, payload)
+	b := messageHash("node-b", topic, payload)
+	if a == b {
+		t.Fatalf("messageHash collided for distinct origins with identical topic+payload")
+	}
+}
+
+func TestSeenRecentlyDedupesSameHash(t *testing.T) {
+	var c messageCache
+	hash := messageHash("node-a", "t", []byte("p"))
+
+	if c.seenRecently(hash) {
+		t.Fatalf("first sighting reported as already seen")
+	}
+	if !c.seenRecently(hash) {
+		t.Fatalf("second sighting within freshWindow should report seen")
+	}
+}
+
+func TestSeenRecentlyDoesNotConflateDifferentOrigins(t *testing.T) {
+	var c messageCache
+	topic, payload := "sensors/temp", []byte("21.5")
+
+	hashA := messageHash("node-a", topic, payload)
+	hashB := messageHash("node-b", topic, payload)
+
+	if c.seenRecently(hashA) {
+		t.Fatalf("node-a publish reported as already seen")
+	}
+	if c.seenRecently(hashB) {
+		t.Fatalf("independent node-b publish with the same topic+payload was wrongly treated as a repeat of node-a's")
+	}
+}
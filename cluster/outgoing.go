@@ -0,0 +1,267 @@
+package cluster
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/werbenhu/amqtt/cluster/session"
+	"github.com/werbenhu/amqtt/config"
+	"github.com/werbenhu/amqtt/ifs"
+	"github.com/werbenhu/amqtt/logger"
+	"github.com/werbenhu/amqtt/packets"
+)
+
+const outgoingBucket = "outgoing"
+
+// resendTimeout is how long an inflight QoS>0 packet waits for its ack
+// before the resend goroutine retransmits it.
+const resendTimeout = 5 * time.Second
+
+const (
+	// stageAwaitingPubrec is a QoS 2 entry's stage from the moment its
+	// PUBLISH is sent until the matching PUBREC arrives.
+	stageAwaitingPubrec = "awaiting_pubrec"
+	// stageAwaitingPubcomp is a QoS 2 entry's stage from PUBREC until the
+	// matching PUBCOMP arrives. ResendLoop resends PUBREL, not the original
+	// PUBLISH, once an entry reaches this stage.
+	stageAwaitingPubcomp = "awaiting_pubcomp"
+)
+
+// Inflight is a QoS>0 PUBLISH this node has sent to a cluster peer and is
+// still waiting to be acknowledged. Stage is only meaningful for QoS 2: it
+// tracks which half of the PUBREC/PUBREL/PUBCOMP handshake is outstanding so
+// a resend retransmits the right packet instead of always the PUBLISH.
+type Inflight struct {
+	Packet  *packets.PublishPacket
+	Stage   string
+	Retries int
+	SentAt  time.Time
+}
+
+// OutgoingTable mirrors the inflight-tracking pattern used by other Go MQTT
+// brokers: one table per cluster Client, keyed by PacketIdentifier, so a
+// forwarded QoS 1/2 PUBLISH is no longer silently downgraded to QoS 0.
+type OutgoingTable struct {
+	mu       sync.Mutex
+	clientId string
+	nextId   uint32
+	inflight map[uint16]*Inflight
+	db       *bolt.DB
+}
+
+// NewOutgoingTable opens (or creates) a BoltDB file under dataDir for
+// clientId and reloads any inflight entries left over from before a
+// restart, so in-flight QoS 1/2 state survives a node restart.
+func NewOutgoingTable(clientId string, dataDir string) (*OutgoingTable, error) {
+	db, err := bolt.Open(filepath.Join(dataDir, clientId+".outgoing.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &OutgoingTable{
+		clientId: clientId,
+		inflight: make(map[uint16]*Inflight),
+		db:       db,
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(outgoingBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var entry Inflight
+			if err := json.Unmarshal(v, &entry); err != nil {
+				logger.Errorf("outgoing table decode entry for %s error:%s", clientId, err)
+				return nil
+			}
+			id := uint16(entry.Packet.MessageID)
+			t.inflight[id] = &entry
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// allocateId hands out the next PacketIdentifier for this client, wrapping
+// at 65535 and skipping any id that is still inflight.
+func (t *OutgoingTable) allocateId() uint16 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		id := uint16(atomic.AddUint32(&t.nextId, 1))
+		if id == 0 {
+			continue
+		}
+		if _, exists := t.inflight[id]; !exists {
+			return id
+		}
+	}
+}
+
+// Register assigns a QoS>0 PUBLISH that is about to be sent a fresh
+// PacketIdentifier, records it as inflight and persists it so it can be
+// resent or rediscovered after a restart.
+func (t *OutgoingTable) Register(packet *packets.PublishPacket) {
+	id := t.allocateId()
+	packet.MessageID = id
+
+	entry := &Inflight{Packet: packet, SentAt: time.Now()}
+	if packet.Qos == 2 {
+		entry.Stage = stageAwaitingPubrec
+	}
+
+	t.mu.Lock()
+	t.inflight[id] = entry
+	t.mu.Unlock()
+
+	t.persist(id, entry)
+}
+
+// MarkPubrec advances a QoS 2 entry to stageAwaitingPubcomp once the peer's
+// PUBREC arrives, so a subsequent resend retransmits PUBREL instead of
+// replaying the original PUBLISH. It returns false if there is no longer an
+// inflight entry for id.
+func (t *OutgoingTable) MarkPubrec(id uint16) bool {
+	t.mu.Lock()
+	entry, ok := t.inflight[id]
+	if ok {
+		entry.Stage = stageAwaitingPubcomp
+		entry.SentAt = time.Now()
+	}
+	t.mu.Unlock()
+
+	if ok {
+		t.persist(id, entry)
+	}
+	return ok
+}
+
+// Resolve removes an inflight entry once it has been fully acknowledged,
+// i.e. on PUBACK for QoS 1 and on PUBCOMP for QoS 2.
+func (t *OutgoingTable) Resolve(id uint16) {
+	t.mu.Lock()
+	delete(t.inflight, id)
+	t.mu.Unlock()
+
+	if err := t.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(outgoingBucket)).Delete(idKey(id))
+	}); err != nil {
+		logger.Errorf("outgoing table delete entry for %s error:%s", t.clientId, err)
+	}
+}
+
+// Get returns the inflight entry for a PacketIdentifier, if any.
+func (t *OutgoingTable) Get(id uint16) (*Inflight, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.inflight[id]
+	return entry, ok
+}
+
+// Snapshot returns every currently inflight entry, packet and handshake
+// Stage together, used to carry pending QoS>0 deliveries across a session
+// takeover without losing how far a QoS 2 handshake had already gotten.
+func (t *OutgoingTable) Snapshot() []*session.InflightMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]*session.InflightMessage, 0, len(t.inflight))
+	for _, entry := range t.inflight {
+		out = append(out, &session.InflightMessage{Packet: entry.Packet, Stage: entry.Stage})
+	}
+	return out
+}
+
+// RegisterResumed re-inserts an inflight entry carried over from a session
+// takeover, preserving both its PacketIdentifier and handshake Stage. Unlike
+// Register, it never reallocates packet.MessageID: MQTT requires a resumed
+// session to resend QoS>0 messages under the same Packet Identifier the
+// client last saw, and a QoS 2 entry already past PUBREC must not come back
+// as a fresh PUBLISH the client has no reason to expect.
+func (t *OutgoingTable) RegisterResumed(packet *packets.PublishPacket, stage string) {
+	entry := &Inflight{Packet: packet, Stage: stage, SentAt: time.Now()}
+
+	t.mu.Lock()
+	t.inflight[packet.MessageID] = entry
+	t.mu.Unlock()
+
+	t.persist(packet.MessageID, entry)
+}
+
+func (t *OutgoingTable) persist(id uint16, entry *Inflight) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Errorf("outgoing table marshal entry for %s error:%s", t.clientId, err)
+		return
+	}
+	if err := t.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(outgoingBucket)).Put(idKey(id), data)
+	}); err != nil {
+		logger.Errorf("outgoing table persist entry for %s error:%s", t.clientId, err)
+	}
+}
+
+// ResendLoop retransmits inflight packets that have outlived resendTimeout
+// without an ack. It runs for the lifetime of client's connection.
+func (t *OutgoingTable) ResendLoop(client ifs.Client, stop <-chan struct{}) {
+	tick := time.NewTicker(resendTimeout)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			t.mu.Lock()
+			due := make([]*Inflight, 0, len(t.inflight))
+			for _, entry := range t.inflight {
+				if time.Since(entry.SentAt) >= resendTimeout {
+					due = append(due, entry)
+				}
+			}
+			t.mu.Unlock()
+
+			for _, entry := range due {
+				entry.Retries++
+				entry.SentAt = time.Now()
+				t.persist(uint16(entry.Packet.MessageID), entry)
+
+				//the peer already acked receipt with PUBREC, so what's missing is
+				//PUBREL, not another copy of the PUBLISH
+				if entry.Stage == stageAwaitingPubcomp {
+					pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+					pubrel.MessageID = entry.Packet.MessageID
+					if err := client.WritePacket(pubrel); err != nil {
+						logger.Errorf("outgoing table resend pubrel to %s error:%s", t.clientId, err)
+					}
+					continue
+				}
+
+				entry.Packet.Dup = true
+				if err := client.WritePacket(entry.Packet); err != nil {
+					logger.Errorf("outgoing table resend to %s error:%s", t.clientId, err)
+				}
+			}
+		}
+	}
+}
+
+func (t *OutgoingTable) Close() error {
+	return t.db.Close()
+}
+
+func idKey(id uint16) []byte {
+	return []byte{byte(id >> 8), byte(id)}
+}
+
+// outgoingDataDir is where per-client OutgoingTable BoltDB files are kept.
+func outgoingDataDir() string {
+	return config.DataDir()
+}
@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/werbenhu/amqtt/packets"
+)
+
+func newTestOutgoingTable(t *testing.T) *OutgoingTable {
+	t.Helper()
+	table, err := NewOutgoingTable("test-client", t.TempDir())
+	if err != nil {
+		t.Fatalf("NewOutgoingTable: %v", err)
+	}
+	t.Cleanup(func() { table.Close() })
+	return table
+}
+
+func TestOutgoingTableRegisterResolve(t *testing.T) {
+	table := newTestOutgoingTable(t)
+
+	packet := &packets.PublishPacket{TopicName: "t", Payload: []byte("p"), Qos: 1}
+	table.Register(packet)
+
+	if _, ok := table.Get(packet.MessageID); !ok {
+		t.Fatalf("Get: expected entry for id %d after Register", packet.MessageID)
+	}
+
+	table.Resolve(packet.MessageID)
+	if _, ok := table.Get(packet.MessageID); ok {
+		t.Fatalf("Get: entry for id %d still present after Resolve", packet.MessageID)
+	}
+}
+
+func TestOutgoingTableMarkPubrec(t *testing.T) {
+	table := newTestOutgoingTable(t)
+
+	packet := &packets.PublishPacket{TopicName: "t", Payload: []byte("p"), Qos: 2}
+	table.Register(packet)
+
+	entry, ok := table.Get(packet.MessageID)
+	if !ok || entry.Stage != stageAwaitingPubrec {
+		t.Fatalf("Stage after Register = %q, want %q", entry.Stage, stageAwaitingPubrec)
+	}
+
+	if !table.MarkPubrec(packet.MessageID) {
+		t.Fatalf("MarkPubrec: expected true for a registered entry")
+	}
+	entry, ok = table.Get(packet.MessageID)
+	if !ok || entry.Stage != stageAwaitingPubcomp {
+		t.Fatalf("Stage after MarkPubrec = %q, want %q", entry.Stage, stageAwaitingPubcomp)
+	}
+
+	if table.MarkPubrec(9999) {
+		t.Fatalf("MarkPubrec: expected false for an id with no inflight entry")
+	}
+}
+
+func TestOutgoingTableSnapshotCarriesStage(t *testing.T) {
+	table := newTestOutgoingTable(t)
+
+	packet := &packets.PublishPacket{TopicName: "t", Payload: []byte("p"), Qos: 2}
+	table.Register(packet)
+	table.MarkPubrec(packet.MessageID)
+
+	snapshot := table.Snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("Snapshot: got %d entries, want 1", len(snapshot))
+	}
+	if snapshot[0].Stage != stageAwaitingPubcomp {
+		t.Errorf("Snapshot stage = %q, want %q", snapshot[0].Stage, stageAwaitingPubcomp)
+	}
+	if snapshot[0].Packet.MessageID != packet.MessageID {
+		t.Errorf("Snapshot MessageID = %d, want %d", snapshot[0].Packet.MessageID, packet.MessageID)
+	}
+}
+
+func TestOutgoingTableRegisterResumedPreservesId(t *testing.T) {
+	table := newTestOutgoingTable(t)
+
+	//simulates a PUBLISH the previous owner had already assigned an id to
+	packet := &packets.PublishPacket{TopicName: "t", Payload: []byte("p"), Qos: 2, MessageID: 4242}
+	table.RegisterResumed(packet, stageAwaitingPubcomp)
+
+	if packet.MessageID != 4242 {
+		t.Fatalf("RegisterResumed reallocated MessageID to %d, want it unchanged at 4242", packet.MessageID)
+	}
+	entry, ok := table.Get(4242)
+	if !ok || entry.Stage != stageAwaitingPubcomp {
+		t.Fatalf("Get(4242): entry = %+v, ok = %v, want Stage %q", entry, ok, stageAwaitingPubcomp)
+	}
+}
+
+func TestOutgoingTableAllocateIdSkipsInflight(t *testing.T) {
+	table := newTestOutgoingTable(t)
+
+	first := &packets.PublishPacket{TopicName: "t", Payload: []byte("p"), Qos: 1}
+	table.Register(first)
+
+	second := &packets.PublishPacket{TopicName: "t", Payload: []byte("p2"), Qos: 1}
+	table.Register(second)
+
+	if first.MessageID == second.MessageID {
+		t.Fatalf("allocateId handed out the same id %d twice while both are inflight", first.MessageID)
+	}
+}
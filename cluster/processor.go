@@ -1,23 +1,89 @@
 package cluster
 
 import (
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/werbenhu/amqtt/cluster/raft"
+	"github.com/werbenhu/amqtt/cluster/session"
+	"github.com/werbenhu/amqtt/config"
 	"github.com/werbenhu/amqtt/ifs"
 	"github.com/werbenhu/amqtt/logger"
 	"github.com/werbenhu/amqtt/packets"
 )
 
+// outgoingEntry pairs a client's OutgoingTable with the channel that stops
+// its resend goroutine once the client disconnects.
+type outgoingEntry struct {
+	table *OutgoingTable
+	stop  chan struct{}
+}
+
 type Processor struct {
-	s ifs.Server
+	s        ifs.Server
+	raft     *raft.Store
+	outgoing sync.Map // clientId string -> *outgoingEntry
+	releases sync.Map // clientId string -> chan struct{}, cancels a pending releaseSession timer
+	cache    messageCache
 }
 
-func NewProcessor(server ifs.Server) *Processor {
+func NewProcessor(server ifs.Server, raftStore *raft.Store) *Processor {
 	p := new(Processor)
 	p.s = server
+	p.raft = raftStore
+	p.cache.startJanitor(server.Context().Done())
 	return p
 }
 
+// outgoingFor returns the OutgoingTable for client, creating it and starting
+// its resend goroutine the first time a QoS>0 PUBLISH is sent to client.
+func (p *Processor) outgoingFor(client ifs.Client) *OutgoingTable {
+	if existing, ok := p.outgoing.Load(client.GetId()); ok {
+		return existing.(*outgoingEntry).table
+	}
+
+	table, err := NewOutgoingTable(client.GetId(), outgoingDataDir())
+	if err != nil {
+		logger.Errorf("create outgoing table for %s error:%s", client.GetId(), err)
+		return nil
+	}
+	entry := &outgoingEntry{table: table, stop: make(chan struct{})}
+
+	actual, loaded := p.outgoing.LoadOrStore(client.GetId(), entry)
+	if loaded {
+		table.Close()
+		return actual.(*outgoingEntry).table
+	}
+	go table.ResendLoop(client, entry.stop)
+	return entry.table
+}
+
+// closeOutgoing stops the resend goroutine and releases the OutgoingTable
+// for a client that has disconnected.
+func (p *Processor) closeOutgoing(clientId string) {
+	if existing, ok := p.outgoing.LoadAndDelete(clientId); ok {
+		entry := existing.(*outgoingEntry)
+		close(entry.stop)
+		if err := entry.table.Close(); err != nil {
+			logger.Errorf("close outgoing table for %s error:%s", clientId, err)
+		}
+	}
+}
+
+// clonePublish returns an independent copy of packet, including its own
+// Payload backing array. Register mutates a packet's MessageID in place and
+// ResendLoop later mutates its Dup flag from a different goroutine, so every
+// recipient of a fan-out needs its own packet instead of aliasing the same
+// struct and racing on it.
+func clonePublish(packet *packets.PublishPacket) *packets.PublishPacket {
+	clone := *packet
+	if packet.Payload != nil {
+		clone.Payload = append([]byte(nil), packet.Payload...)
+	}
+	return &clone
+}
+
 func (p *Processor) DoPublish(topic string, packet *packets.PublishPacket) {
 
 	//send message to the clients in the current node that have subscribed to the topic
@@ -28,20 +94,87 @@ func (p *Processor) DoPublish(topic string, packet *packets.PublishPacket) {
 		//a message is only sent to a client once, here to remove the duplicate
 		if !history[client.GetId()] {
 			history[client.GetId()] = true
-			client.WritePacket(packet)
+
+			//QoS>0 is tracked in the client's OutgoingTable so PUBACK/PUBREC/PUBCOMP
+			//can resolve it instead of the message silently being downgraded to QoS 0;
+			//each recipient gets its own packet since Register/ResendLoop mutate it
+			//in place and two subscribers must never alias the same struct
+			outgoing := packet
+			if packet.Qos > 0 {
+				outgoing = clonePublish(packet)
+				if table := p.outgoingFor(client); table != nil {
+					table.Register(outgoing)
+				}
+			}
+			client.WritePacket(outgoing)
 			atomic.AddInt64(&p.s.State().PubSent, 1)
 		}
 	}
 }
 
+// forwardToCluster relays a PUBLISH received from one cluster peer on to
+// every other peer subscribed to topic, skipping the peer it came from.
+// origin/raw are the unwrapped sender id and payload; template supplies the
+// rest of the packet's fields (Qos, Retain, TopicName, ...). Each peer gets
+// its own packet re-wrapped with origin so the hash used for loop detection
+// stays stable across every hop, and QoS>0 forwards are tracked in that
+// peer's OutgoingTable the same way a real client's forwarded PUBLISH is,
+// instead of being silently downgraded to QoS 0 on the one path that is
+// genuinely cross-node.
+func (p *Processor) forwardToCluster(from ifs.Client, topic string, origin string, raw []byte, template *packets.PublishPacket) {
+	subs := p.s.ClusterTopics().Subscribers(topic)
+	for _, sub := range subs {
+		peer := sub.(ifs.Client)
+		if peer.GetId() == from.GetId() {
+			continue
+		}
+
+		outgoing := clonePublish(template)
+		outgoing.Payload = wrapOrigin(origin, raw)
+
+		if outgoing.Qos > 0 {
+			if table := p.outgoingFor(peer); table != nil {
+				table.Register(outgoing)
+			}
+		}
+		peer.WritePacket(outgoing)
+	}
+}
+
 func (p *Processor) ProcessPublish(client ifs.Client, packet *packets.PublishPacket) {
 	topic := packet.TopicName
-	p.DoPublish(topic, packet)
 
-	//if other cluster node have this retain message, then the current cluster node must delete this retain message
-	//ensure that there is only one retain message for a topic in the entire clusters
+	//unwrap whatever origin a previous hop already stamped this message with;
+	//a message on its first cluster hop (ok==false) gets stamped with the id
+	//of the peer it came from, so origin stays the same at every hop of a
+	//multi-hop path instead of being overwritten by each relay
+	origin, raw, ok := unwrapOrigin(packet.Payload)
+	if !ok {
+		origin = client.GetId()
+	}
+
+	local := clonePublish(packet)
+	local.Payload = raw
+	p.DoPublish(topic, local)
+
+	//a message that is circulating a non-full-mesh topology (A->B->C->A) hashes
+	//the same every hop because origin is preserved rather than re-stamped, so
+	//a fresh hit here means forwarding would loop it back
+	if !p.cache.seenRecently(messageHash(origin, topic, raw)) {
+		p.forwardToCluster(client, topic, origin, raw, packet)
+	}
+
+	//retained messages are proposed to the raft group instead of applied locally,
+	//so two nodes receiving concurrent retained publishes can no longer delete
+	//each other's copy; BrokerTopics is only updated once the entry commits
 	if packet.Retain {
-		p.s.BrokerTopics().RemoveRetain(topic)
+		op := raft.OpSet
+		if len(raw) == 0 {
+			op = raft.OpDelete
+		}
+		if err := p.raft.Propose(op, topic, raw, packet.Qos); err != nil {
+			logger.Errorf("propose retain message for topic:%s error:%s", topic, err)
+		}
 	}
 }
 
@@ -83,9 +216,56 @@ func (p *Processor) ProcessPing(client ifs.Client) {
 	}
 }
 
+// ProcessPuback resolves the inflight entry for a QoS 1 PUBLISH this node
+// forwarded to client.
+func (p *Processor) ProcessPuback(client ifs.Client, packet *packets.PubackPacket) {
+	if existing, ok := p.outgoing.Load(client.GetId()); ok {
+		existing.(*outgoingEntry).table.Resolve(packet.MessageID)
+	}
+}
+
+// ProcessPubrec is the first step of the QoS 2 handshake for a PUBLISH this
+// node forwarded: the entry stays inflight until the matching PUBCOMP, so it
+// is marked as awaiting PUBCOMP instead of being resolved, which is what
+// makes ResendLoop retransmit PUBREL rather than the original PUBLISH if
+// the handshake stalls here.
+func (p *Processor) ProcessPubrec(client ifs.Client, packet *packets.PubrecPacket) {
+	if existing, ok := p.outgoing.Load(client.GetId()); ok {
+		existing.(*outgoingEntry).table.MarkPubrec(packet.MessageID)
+	}
+
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = packet.MessageID
+	if err := client.WritePacket(pubrel); err != nil {
+		logger.Errorf("send pubrel to %s error:%s", client.GetId(), err)
+	}
+}
+
+// ProcessPubcomp completes the QoS 2 handshake for a PUBLISH this node
+// forwarded to client.
+func (p *Processor) ProcessPubcomp(client ifs.Client, packet *packets.PubcompPacket) {
+	if existing, ok := p.outgoing.Load(client.GetId()); ok {
+		existing.(*outgoingEntry).table.Resolve(packet.MessageID)
+	}
+}
+
 func (p *Processor) ProcessDisconnect(client ifs.Client) {
 	logger.Debugf("cluster ProcessDisconnect clientId:%s", client.GetId())
 	p.s.Clusters().Delete(client.GetId())
+
+	//snapshot what this client had live before the outgoing table goes away,
+	//so releaseSession can hand it to whichever node takes the session over
+	subscriptions := make([]string, 0, len(client.Topics()))
+	for topic := range client.Topics() {
+		subscriptions = append(subscriptions, topic)
+	}
+	var inflight []*session.InflightMessage
+	if existing, ok := p.outgoing.Load(client.GetId()); ok {
+		inflight = existing.(*outgoingEntry).table.Snapshot()
+	}
+
+	p.closeOutgoing(client.GetId())
+	p.releaseSession(client.GetId(), subscriptions, inflight)
 	client.Close()
 
 	//when a node in the cluster is disconnected, the node must unsubscript it's all topics
@@ -96,15 +276,133 @@ func (p *Processor) ProcessDisconnect(client ifs.Client) {
 	}
 }
 
+// cancelPendingRelease stops a previously armed releaseSession timer for
+// clientId, if one is still waiting. It is called both when a new disconnect
+// re-arms the timer and when a reconnect claims the session back, so a stale
+// timer from an earlier grace period can never fire after the session has
+// moved on.
+func (p *Processor) cancelPendingRelease(clientId string) {
+	if existing, ok := p.releases.LoadAndDelete(clientId); ok {
+		close(existing.(chan struct{}))
+	}
+}
+
+// releaseSession drops ownership immediately for a clean session, or
+// refreshes the replicated record with subscriptions/inflight straight off
+// the departing client and keeps it alive on this node for
+// SessionExpiryInterval before releasing it, so a takeover on another node
+// has a real session to resume rather than just an empty claim.
+func (p *Processor) releaseSession(clientId string, subscriptions []string, inflight []*session.InflightMessage) {
+	record, ok := p.raft.Lookup(clientId)
+	if !ok || record.OwnerNode != config.ClusterName() {
+		return
+	}
+
+	//a client that reconnected and disconnected again inside its previous
+	//grace period must not have that earlier timer release the new one
+	p.cancelPendingRelease(clientId)
+
+	if record.CleanSession || record.SessionExpiryInterval <= 0 {
+		if err := p.raft.Release(clientId); err != nil {
+			logger.Errorf("release session for clientId:%s error:%s", clientId, err)
+		}
+		return
+	}
+
+	snapshot := *record
+	snapshot.Subscriptions = subscriptions
+	snapshot.Inflight = inflight
+	if _, err := p.raft.Claim(&snapshot); err != nil {
+		logger.Errorf("snapshot session for clientId:%s error:%s", clientId, err)
+	}
+
+	stop := make(chan struct{})
+	p.releases.Store(clientId, stop)
+
+	expiry := record.SessionExpiryInterval
+	go func() {
+		select {
+		case <-time.After(expiry):
+		case <-stop:
+			return
+		}
+		if current, ok := p.raft.Lookup(clientId); ok && current.OwnerNode == config.ClusterName() {
+			if err := p.raft.Release(clientId); err != nil {
+				logger.Errorf("release expired session for clientId:%s error:%s", clientId, err)
+			}
+		}
+		p.releases.CompareAndDelete(clientId, stop)
+	}()
+}
+
+// resumeSession re-subscribes client to the topics its previous owner had
+// live and redelivers whatever was still inflight there, so SessionPresent=true
+// actually means something instead of the client being told its session
+// survived and then receiving nothing until it resubscribes itself.
+func (p *Processor) resumeSession(client ifs.Client, previous *session.Record) {
+	for _, topic := range previous.Subscriptions {
+		p.s.ClusterTopics().Subscribe(topic, client.GetId(), client)
+		client.AddTopic(topic, client.GetId())
+	}
+
+	if len(previous.Inflight) == 0 {
+		return
+	}
+	table := p.outgoingFor(client)
+	if table == nil {
+		return
+	}
+	for _, msg := range previous.Inflight {
+		table.RegisterResumed(msg.Packet, msg.Stage)
+
+		//a QoS 2 entry already past PUBREC is waiting on PUBCOMP, not a fresh
+		//PUBLISH the client has no reason to expect
+		if msg.Stage == stageAwaitingPubcomp {
+			pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubrel.MessageID = msg.Packet.MessageID
+			if err := client.WritePacket(pubrel); err != nil {
+				logger.Errorf("resume pubrel to %s error:%s", client.GetId(), err)
+			}
+			continue
+		}
+		if err := client.WritePacket(msg.Packet); err != nil {
+			logger.Errorf("resume inflight publish to %s error:%s", client.GetId(), err)
+		}
+	}
+}
+
 func (p *Processor) ProcessConnack(client ifs.Client, cp *packets.ConnackPacket) {
 	logger.Debugf("cluster ProcessConnack clientId:%s", client.GetId())
 }
 
 func (p *Processor) ProcessConnect(client ifs.Client, cp *packets.ConnectPacket) {
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	connack.SessionPresent = cp.CleanSession
 	connack.ReturnCode = cp.Validate()
 
+	//claiming the session here proposes ownership to the raft group; if another
+	//node still owns it, committing the claim drives onSessionTakeover there so
+	//it can disconnect its stale client instead of leaving two live owners
+	if !cp.CleanSession {
+		previous, err := p.raft.Claim(&session.Record{
+			ClientId:              cp.ClientIdentifier,
+			OwnerNode:             config.ClusterName(),
+			CleanSession:          cp.CleanSession,
+			SessionExpiryInterval: time.Duration(cp.SessionExpiryInterval) * time.Second,
+		})
+		if err != nil {
+			logger.Errorf("claim session for clientId:%s error:%s", cp.ClientIdentifier, err)
+		}
+
+		//the session is live on this node again; a release timer armed by an
+		//earlier disconnect must not fire out from under this new connection
+		p.cancelPendingRelease(cp.ClientIdentifier)
+
+		connack.SessionPresent = previous != nil
+		if previous != nil {
+			p.resumeSession(client, previous)
+		}
+	}
+
 	err := client.WritePacket(connack)
 	if err != nil {
 		logger.Error("send connack error, ", err)
@@ -130,9 +428,12 @@ func (p *Processor) ProcessMessage(client ifs.Client, cp packets.ControlPacket)
 		p.ProcessDisconnect(client)
 
 	case *packets.PubackPacket:
+		p.ProcessPuback(client, packet)
 	case *packets.PubrecPacket:
+		p.ProcessPubrec(client, packet)
 	case *packets.PubrelPacket:
 	case *packets.PubcompPacket:
+		p.ProcessPubcomp(client, packet)
 	case *packets.SubackPacket:
 	case *packets.UnsubackPacket:
 	case *packets.PingrespPacket:
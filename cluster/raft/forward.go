@@ -0,0 +1,105 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/werbenhu/amqtt/logger"
+)
+
+// forwardOffset is added to the raft bind port to get the port this node's
+// forwarder RPC listens on, on every node, so a follower can find a peer's
+// forwarder from nothing but that peer's raft bind address.
+const forwardOffset = 1
+
+// forwarder lets a follower hand a Command to whichever node is currently
+// raft leader, since hashicorp/raft only accepts Apply on the leader itself
+// and a client may dial any node in the mesh, not just the leader.
+type forwarder struct {
+	store *Store
+}
+
+// Apply is exported for net/rpc; it only succeeds on the current leader.
+func (f *forwarder) Apply(data []byte, reply *struct{}) error {
+	if f.store.raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	future := f.store.raft.Apply(data, 5*time.Second)
+	return future.Error()
+}
+
+func forwardAddr(raftBind string) (string, error) {
+	host, portStr, err := net.SplitHostPort(raftBind)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port+forwardOffset)), nil
+}
+
+// startForwarder listens for Apply RPCs forwarded by followers and serves
+// them for as long as the Store is alive.
+func (s *Store) startForwarder(raftBind string) error {
+	addr, err := forwardAddr(raftBind)
+	if err != nil {
+		return fmt.Errorf("raft store resolve forward addr err:%s", err)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("raft store listen forward addr %s err:%s", addr, err)
+	}
+	s.forwardListener = listener
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Forwarder", &forwarder{store: s}); err != nil {
+		listener.Close()
+		return fmt.Errorf("raft store register forwarder err:%s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	return nil
+}
+
+// forwardToLeader hands data to the current leader's forwarder and blocks
+// until it has been applied there.
+func (s *Store) forwardToLeader(data []byte) error {
+	leaderAddr := s.Leader()
+	if strings.TrimSpace(leaderAddr) == "" {
+		return fmt.Errorf("raft store forward: no leader available")
+	}
+
+	addr, err := forwardAddr(leaderAddr)
+	if err != nil {
+		return err
+	}
+
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("raft store dial leader forwarder %s err:%s", addr, err)
+	}
+	defer client.Close()
+
+	var reply struct{}
+	if err := client.Call("Forwarder.Apply", data, &reply); err != nil {
+		logger.Errorf("raft store forward to leader %s error:%s", addr, err)
+		return err
+	}
+	return nil
+}
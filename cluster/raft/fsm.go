@@ -0,0 +1,198 @@
+package raft
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/hashicorp/raft"
+	"github.com/werbenhu/amqtt/cluster/session"
+	"github.com/werbenhu/amqtt/ifs"
+	"github.com/werbenhu/amqtt/logger"
+	"github.com/werbenhu/amqtt/packets"
+)
+
+const (
+	// KindRetain commands apply to the retained-message store.
+	KindRetain = "retain"
+	// KindSession commands apply to the session registry.
+	KindSession = "session"
+
+	// OpSet proposes that a retained message be stored for a topic.
+	OpSet = "set"
+	// OpDelete proposes that a topic's retained message be removed.
+	OpDelete = "delete"
+
+	// OpClaim proposes that a clientId's session be (re)owned by a node.
+	OpClaim = "claim"
+	// OpRelease proposes that a clientId's session be dropped entirely.
+	OpRelease = "release"
+)
+
+// Command is the log entry applied by every node in the raft group. A
+// Command with Kind KindRetain carries a retained-message op; one with
+// KindSession carries a session.Store op. Every node applies a committed
+// Command before updating its own local state, which is what lets the
+// same group back both the retained-message store and the session registry.
+type Command struct {
+	Kind    string          `json:"kind"`
+	Op      string          `json:"op"`
+	Topic   string          `json:"topic,omitempty"`
+	Payload []byte          `json:"payload,omitempty"`
+	Qos     byte            `json:"qos,omitempty"`
+	Session *session.Record `json:"session,omitempty"`
+}
+
+// FSM is the raft finite state machine backing both the retained-message
+// store and the session registry. It mirrors committed retain ops into the
+// node's own BrokerTopics so existing SearchRetain callers keep working
+// unchanged, and keeps an in-memory map of session.Records for Store.Lookup.
+type FSM struct {
+	mu         sync.Mutex
+	s          ifs.Server
+	sessions   map[string]*session.Record
+	onTakeover session.TakeoverHandler
+}
+
+// NewFSM builds the FSM. onTakeover, if non-nil, is called whenever a
+// KindSession claim commits and replaces a record this FSM previously held,
+// so the node that used to own the session can disconnect its stale client.
+func NewFSM(server ifs.Server, onTakeover session.TakeoverHandler) *FSM {
+	return &FSM{
+		s:          server,
+		sessions:   make(map[string]*session.Record),
+		onTakeover: onTakeover,
+	}
+}
+
+func (f *FSM) Apply(log *raft.Log) interface{} {
+	var cmd Command
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		logger.Errorf("raft fsm unmarshal command error:%s", err)
+		return err
+	}
+
+	switch cmd.Kind {
+	case KindSession:
+		return f.applySession(&cmd)
+	default:
+		return f.applyRetain(&cmd)
+	}
+}
+
+func (f *FSM) applyRetain(cmd *Command) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd.Op {
+	case OpSet:
+		packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		packet.TopicName = cmd.Topic
+		packet.Payload = cmd.Payload
+		packet.Qos = cmd.Qos
+		packet.Retain = true
+		f.s.BrokerTopics().Retain(cmd.Topic, packet)
+	case OpDelete:
+		f.s.BrokerTopics().RemoveRetain(cmd.Topic)
+	default:
+		logger.Errorf("raft fsm unknown retain op:%s", cmd.Op)
+	}
+	return nil
+}
+
+func (f *FSM) applySession(cmd *Command) interface{} {
+	f.mu.Lock()
+	var previous *session.Record
+	switch cmd.Op {
+	case OpClaim:
+		previous = f.sessions[cmd.Session.ClientId]
+		f.sessions[cmd.Session.ClientId] = cmd.Session
+	case OpRelease:
+		previous = f.sessions[cmd.Session.ClientId]
+		delete(f.sessions, cmd.Session.ClientId)
+	default:
+		f.mu.Unlock()
+		logger.Errorf("raft fsm unknown session op:%s", cmd.Op)
+		return nil
+	}
+	f.mu.Unlock()
+
+	if cmd.Op == OpClaim && f.onTakeover != nil && previous != nil && previous.OwnerNode != cmd.Session.OwnerNode {
+		f.onTakeover(previous, cmd.Session)
+	}
+	return nil
+}
+
+// Lookup implements the read half of session.Store against this node's own
+// copy of the replicated registry.
+func (f *FSM) Lookup(clientId string) (*session.Record, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	record, ok := f.sessions[clientId]
+	return record, ok
+}
+
+// clusterSnapshot is the FSMSnapshot used to bootstrap nodes that join the
+// cluster after the log has been truncated, instead of relying on SyncTopics.
+type clusterSnapshot struct {
+	Retains  map[string]*packets.PublishPacket `json:"retains"`
+	Sessions map[string]*session.Record        `json:"sessions"`
+}
+
+func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	retains := make(map[string]*packets.PublishPacket)
+	f.s.BrokerTopics().RangeTopics(func(topic, client interface{}) bool {
+		if matched, ok := f.s.BrokerTopics().SearchRetain(topic.(string)); ok {
+			for _, retain := range matched {
+				retains[topic.(string)] = retain.(*packets.PublishPacket)
+			}
+		}
+		return true
+	})
+
+	sessions := make(map[string]*session.Record, len(f.sessions))
+	for clientId, record := range f.sessions {
+		sessions[clientId] = record
+	}
+
+	return &clusterSnapshot{Retains: retains, Sessions: sessions}, nil
+}
+
+func (f *FSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var snap clusterSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for topic, packet := range snap.Retains {
+		f.s.BrokerTopics().Retain(topic, packet)
+	}
+	f.sessions = snap.Sessions
+	if f.sessions == nil {
+		f.sessions = make(map[string]*session.Record)
+	}
+	return nil
+}
+
+func (s *clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := func() error {
+		encoder := json.NewEncoder(sink)
+		if err := encoder.Encode(s); err != nil {
+			return err
+		}
+		return sink.Close()
+	}()
+	if err != nil {
+		sink.Cancel()
+	}
+	return err
+}
+
+func (s *clusterSnapshot) Release() {}
@@ -0,0 +1,147 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/werbenhu/amqtt/cluster/session"
+	"github.com/werbenhu/amqtt/config"
+	"github.com/werbenhu/amqtt/ifs"
+	"github.com/werbenhu/amqtt/logger"
+)
+
+// Store runs a raft group across config.Clusters() and keeps retained
+// messages and the session registry consistent via FSM. ProcessPublish
+// proposes to it for every retained PUBLISH instead of calling
+// BrokerTopics().RemoveRetain directly, which removes the race where two
+// nodes delete each other's retained copy of the same topic; the cluster
+// Processor claims sessions through it on every persistent-session CONNECT
+// so ownership never has two live owners at once. Store implements
+// session.Store.
+type Store struct {
+	raft            *raft.Raft
+	fsm             *FSM
+	forwardListener net.Listener
+}
+
+// NewStore brings up a raft node bound to raftBind, persisting its log and
+// snapshots under dataDir. peers should contain every node in
+// config.Clusters() including the local one; the group bootstraps itself
+// the first time it is started with no existing state. onTakeover is called
+// whenever a session this node used to own is claimed by another node.
+func NewStore(server ifs.Server, nodeId string, raftBind string, dataDir string, peers []raft.Server, onTakeover session.TakeoverHandler) (*Store, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("raft store create data dir %s err:%s", dataDir, err)
+	}
+
+	fsm := NewFSM(server, onTakeover)
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(nodeId)
+
+	addr, err := net.ResolveTCPAddr("tcp", raftBind)
+	if err != nil {
+		return nil, fmt.Errorf("raft store resolve addr %s err:%s", raftBind, err)
+	}
+	transport, err := raft.NewTCPTransport(raftBind, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("raft store new transport err:%s", err)
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(dataDir, 2, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("raft store new snapshot store err:%s", err)
+	}
+
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("raft store new bolt store err:%s", err)
+	}
+
+	r, err := raft.NewRaft(raftConfig, fsm, boltStore, boltStore, snapshots, transport)
+	if err != nil {
+		return nil, fmt.Errorf("raft store new raft err:%s", err)
+	}
+
+	hasState, err := raft.HasExistingState(boltStore, boltStore, snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("raft store has existing state err:%s", err)
+	}
+	if !hasState {
+		logger.Infof("raft store bootstrapping cluster with peers:%+v", peers)
+		r.BootstrapCluster(raft.Configuration{Servers: peers})
+	}
+
+	store := &Store{raft: r, fsm: fsm}
+	if err := store.startForwarder(raftBind); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Propose proposes a retained-message Command to the leader. Only the
+// leader replicates it; followers apply it to their own BrokerTopics once
+// it commits.
+func (s *Store) Propose(op string, topic string, payload []byte, qos byte) error {
+	return s.apply(Command{Kind: KindRetain, Op: op, Topic: topic, Payload: payload, Qos: qos})
+}
+
+// Claim implements session.Store: it proposes clientId's new owner to the
+// raft group and returns the previous owner once the entry commits.
+func (s *Store) Claim(record *session.Record) (*session.Record, error) {
+	previous, _ := s.fsm.Lookup(record.ClientId)
+	if err := s.apply(Command{Kind: KindSession, Op: OpClaim, Session: record}); err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// Release implements session.Store.
+func (s *Store) Release(clientId string) error {
+	return s.apply(Command{Kind: KindSession, Op: OpRelease, Session: &session.Record{ClientId: clientId}})
+}
+
+// Lookup implements session.Store against this node's local copy of the
+// replicated registry.
+func (s *Store) Lookup(clientId string) (*session.Record, bool) {
+	return s.fsm.Lookup(clientId)
+}
+
+// apply proposes cmd on the leader, forwarding it there over RPC first if
+// this node is only a follower. A client can dial any node in the mesh, not
+// necessarily the leader, so without this every write would fail on every
+// node except whichever one happens to be leader.
+func (s *Store) apply(cmd Command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	if s.IsLeader() {
+		future := s.raft.Apply(data, 5*time.Second)
+		return future.Error()
+	}
+	return s.forwardToLeader(data)
+}
+
+func (s *Store) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+func (s *Store) Leader() string {
+	addr, _ := s.raft.LeaderWithID()
+	return string(addr)
+}
+
+func (s *Store) Shutdown() error {
+	if s.forwardListener != nil {
+		s.forwardListener.Close()
+	}
+	return s.raft.Shutdown().Error()
+}
@@ -0,0 +1,56 @@
+package session
+
+import (
+	"time"
+
+	"github.com/werbenhu/amqtt/packets"
+)
+
+// InflightMessage is a QoS>0 PUBLISH a session's previous owner was still
+// waiting on an ack for. Stage carries the QoS 2 handshake phase
+// (stageAwaitingPubrec/stageAwaitingPubcomp in the cluster package) across a
+// takeover, and Packet.MessageID is preserved as-is when resuming: MQTT
+// requires a resumed session to resend QoS>0 messages under the same
+// Packet Identifier the client last saw, not a freshly allocated one.
+type InflightMessage struct {
+	Packet *packets.PublishPacket `json:"packet"`
+	Stage  string                 `json:"stage,omitempty"`
+}
+
+// Record is the cluster-wide view of a single MQTT client's session: which
+// node currently owns the live TCP connection, and enough state to resume
+// the session on a different node without the client noticing. Subscriptions
+// and Inflight are refreshed by the owning node on disconnect so a takeover
+// elsewhere has something real to resume instead of just an empty claim.
+type Record struct {
+	ClientId              string             `json:"client_id"`
+	OwnerNode             string             `json:"owner_node"`
+	CleanSession          bool               `json:"clean_session"`
+	Subscriptions         []string           `json:"subscriptions"`
+	Inflight              []*InflightMessage `json:"inflight,omitempty"`
+	SessionExpiryInterval time.Duration      `json:"session_expiry_interval"`
+	ExpiresAt             time.Time          `json:"expires_at,omitempty"`
+}
+
+// Store is the replicated session directory: it tracks which node owns a
+// clientId so a CONNECT landing on a different node can trigger a takeover
+// instead of leaving two live owners for the same client. Implementations
+// can be backed by the cluster's raft group, or swapped for something like
+// Redis or a dedicated BoltDB store.
+type Store interface {
+	// Claim records clientId as owned by record.OwnerNode, replacing any
+	// previous owner. It returns the previous record, if there was one.
+	Claim(record *Record) (previous *Record, err error)
+
+	// Release drops ownership of clientId, e.g. once its
+	// SessionExpiryInterval elapses with CleanSession false.
+	Release(clientId string) error
+
+	// Lookup returns the current owner record for clientId, if any.
+	Lookup(clientId string) (*Record, bool)
+}
+
+// TakeoverHandler is invoked on every node once a Claim commits for a
+// clientId that node used to own, so it can disconnect its stale local
+// connection and flush any inflight queue for that client.
+type TakeoverHandler func(previous *Record, next *Record)
@@ -0,0 +1,114 @@
+package config
+
+import "time"
+
+// Typ identifies which end of a cluster TCP connection a Client represents.
+const (
+	TypServer = "server"
+	TypClient = "client"
+)
+
+// ClusterNode describes one member of the cluster mesh: either a static
+// seed entry from the config file, or a peer learned through discovery.
+// RaftBind and GossipHost come from static seed entries, where they serve as
+// raft bootstrap peer and gossip seed addresses; they are empty for peers
+// learned through discovery.
+type ClusterNode struct {
+	Name       string
+	Host       string
+	RaftBind   string
+	GossipHost string
+}
+
+type tlsConfig struct {
+	Enable         bool
+	CertFile       string
+	KeyFile        string
+	Ca             string
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+type clusterConfig struct {
+	Name         string
+	Host         string
+	Nodes        []ClusterNode
+	Tls          tlsConfig
+	RaftBind     string
+	RaftDir      string
+	GossipPort   int
+	LeaveTimeout time.Duration
+	DataDir      string
+}
+
+var cluster = clusterConfig{
+	RaftDir:      "data/raft",
+	DataDir:      "data",
+	GossipPort:   7946,
+	LeaveTimeout: 5 * time.Second,
+}
+
+// ClusterName is this node's identity within the cluster mesh.
+func ClusterName() string {
+	return cluster.Name
+}
+
+// ClusterHost is the TCP address this node's cluster server listens on.
+func ClusterHost() string {
+	return cluster.Host
+}
+
+// ClusterTls reports whether cluster connections are secured with TLS.
+func ClusterTls() bool {
+	return cluster.Tls.Enable
+}
+
+// Clusters returns the statically configured seed peers.
+func Clusters() []ClusterNode {
+	return cluster.Nodes
+}
+
+func CertFile() string {
+	return cluster.Tls.CertFile
+}
+
+func KeyFile() string {
+	return cluster.Tls.KeyFile
+}
+
+func Ca() string {
+	return cluster.Tls.Ca
+}
+
+func ClientCertFile() string {
+	return cluster.Tls.ClientCertFile
+}
+
+func ClientKeyFile() string {
+	return cluster.Tls.ClientKeyFile
+}
+
+// RaftBind is the local bind address for this node's raft transport.
+func RaftBind() string {
+	return cluster.RaftBind
+}
+
+// RaftDir is where this node's raft log, stable store and snapshots live.
+func RaftDir() string {
+	return cluster.RaftDir
+}
+
+// GossipPort is the memberlist bind/advertise port used for discovery.
+func GossipPort() int {
+	return cluster.GossipPort
+}
+
+// ClusterLeaveTimeout bounds how long a graceful memberlist Leave waits.
+func ClusterLeaveTimeout() time.Duration {
+	return cluster.LeaveTimeout
+}
+
+// DataDir is where per-node cluster state (outgoing tables, etc.) is kept.
+func DataDir() string {
+	return cluster.DataDir
+}